@@ -46,15 +46,20 @@
 package ldap
 
 import (
-	"bytes"
+	"encoding/asn1"
 	enchex "encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
-
-	ber "gopkg.in/asn1-ber.v1"
 )
 
+// specialChars are the characters that encodeValue escapes wherever they
+// appear in a value, in addition to a leading '#'/space, a trailing space, and
+// NUL: RFC 4514's <escaped> set and ESC, which must be escaped, plus EQUALS,
+// which may be. ParseDN accepts an unescaped '=' inside a value.
+const specialChars = `"+,;<>\=`
+
 // AttributeTypeAndValue represents an attributeTypeAndValue from https://tools.ietf.org/html/rfc4514
 type AttributeTypeAndValue struct {
 	// Type is the attribute type
@@ -73,105 +78,363 @@ type DN struct {
 	RDNs []*RelativeDN
 }
 
-// ParseDN returns a distinguishedName or an error
+// ParseDN returns a distinguishedName or an error. It is a strict,
+// RFC 4514-conformant parser: an empty attribute type, a malformed escape
+// sequence, an unbalanced "#" hex value, or a "+" beginning an RDN are all
+// rejected rather than silently tolerated.
+//
+// The distinguishedName production is itself optional, so the empty string
+// is a valid DN with zero RDNs (e.g. the root DSE).
 func ParseDN(str string) (*DN, error) {
 	dn := new(DN)
-	dn.RDNs = make([]*RelativeDN, 0)
+	if str == "" {
+		return dn, nil
+	}
+
 	rdn := new(RelativeDN)
-	rdn.Attributes = make([]*AttributeTypeAndValue, 0)
-	buffer := bytes.Buffer{}
-	attribute := new(AttributeTypeAndValue)
-	escaping := false
-
-	unescapedTrailingSpaces := 0
-	stringFromBuffer := func() string {
-		s := buffer.String()
-		s = s[0 : len(s)-unescapedTrailingSpaces]
-		buffer.Reset()
-		unescapedTrailingSpaces = 0
-		return s
+	remaining := str
+
+	for {
+		attr := new(AttributeTypeAndValue)
+
+		typ, rest, err := parseType(remaining)
+		if err != nil {
+			return nil, err
+		}
+		attr.Type = typ
+		remaining = rest
+
+		if len(remaining) == 0 || remaining[0] != '=' {
+			return nil, errors.New("ldap: expected '=' after attribute type")
+		}
+		remaining = remaining[1:]
+
+		var value string
+		if len(remaining) > 0 && remaining[0] == '#' {
+			value, remaining, err = parseHexValue(remaining[1:])
+		} else {
+			value, remaining, err = parseValue(remaining)
+		}
+		if err != nil {
+			return nil, err
+		}
+		attr.Value = value
+		rdn.Attributes = append(rdn.Attributes, attr)
+
+		if len(remaining) == 0 {
+			dn.RDNs = append(dn.RDNs, rdn)
+			return dn, nil
+		}
+
+		switch remaining[0] {
+		case '+':
+			remaining = remaining[1:]
+		case ',':
+			dn.RDNs = append(dn.RDNs, rdn)
+			rdn = new(RelativeDN)
+			remaining = remaining[1:]
+		default:
+			return nil, fmt.Errorf("ldap: unexpected character %q in DN", remaining[0])
+		}
 	}
+}
 
-	for i := 0; i < len(str); i++ {
-		char := str[i]
-		if escaping {
-			unescapedTrailingSpaces = 0
-			escaping = false
-			switch char {
-			case ' ', '"', '#', '+', ',', ';', '<', '=', '>', '\\':
-				buffer.WriteByte(char)
-				continue
-			}
-			// Not a special character, assume hex encoded octet
-			if len(str) == i+1 {
-				return nil, errors.New("Got corrupted escaped character")
-			}
+// parseType consumes an attributeType (descr or numericoid) from the front
+// of s and returns it along with the remaining unparsed string. Attribute
+// types are never escaped, so parsing simply runs up to the next '=', RDN
+// delimiter, or other character that cannot appear in a type (';', '\\', '"',
+// '<', '>').
+func parseType(s string) (typ string, rest string, err error) {
+	i := 0
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	start := i
+loop:
+	for i < len(s) {
+		switch s[i] {
+		case '=', ',', '+', ';', '\\', '"', '<', '>':
+			break loop
+		}
+		i++
+	}
+	typ = strings.TrimRight(s[start:i], " ")
+	if typ == "" {
+		return "", s, errors.New("ldap: empty attribute type")
+	}
+	return typ, s[i:], nil
+}
 
-			dst := []byte{0}
-			n, err := enchex.Decode([]byte(dst), []byte(str[i:i+2]))
+// parseValue consumes an RFC 4514 string value (escapes and all) from the
+// front of s and returns its decoded form, along with the remaining
+// unparsed string starting at the next unescaped ',', '+' or the end of s.
+// RFC 4514 uses COMMA alone to separate RDNs; unlike the legacy RFC 2253
+// grammar it does not treat SEMI as an alternate separator, so an unescaped
+// ';' found here is left for decodeString to reject as an invalid literal.
+func parseValue(s string) (string, string, error) {
+	i := 0
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			n, err := parseEscape(s[i:])
 			if err != nil {
-				return nil, fmt.Errorf("Failed to decode escaped character: %s", err)
-			} else if n != 1 {
-				return nil, fmt.Errorf("Expected 1 byte when un-escaping, got %d", n)
+				return "", "", err
 			}
-			buffer.WriteByte(dst[0])
+			i += n
+		case ',', '+':
+			value, err := decodeString(s[:i])
+			return value, s[i:], err
+		default:
 			i++
-		} else if char == '\\' {
-			unescapedTrailingSpaces = 0
-			escaping = true
-		} else if char == '=' {
-			attribute.Type = stringFromBuffer()
-			// Special case: If the first character in the value is # the
-			// following data is BER encoded so we can just fast forward
-			// and decode.
-			if len(str) > i+1 && str[i+1] == '#' {
-				i += 2
-				index := strings.IndexAny(str[i:], ",+")
-				data := str
-				if index > 0 {
-					data = str[i : i+index]
-				} else {
-					data = str[i:]
-				}
-				rawBER, err := enchex.DecodeString(data)
+		}
+	}
+	value, err := decodeString(s)
+	return value, "", err
+}
+
+// parseEscape validates the RFC 4514 escape sequence beginning at s[0] (a
+// backslash) and returns the number of bytes it occupies: 2 for one of the
+// special-character escapes, 3 for a "\HH" hex pair.
+func parseEscape(s string) (int, error) {
+	if len(s) < 2 {
+		return 0, errors.New("ldap: DN ended with incomplete escape sequence")
+	}
+	switch s[1] {
+	case ' ', '"', '#', '+', ',', ';', '<', '=', '>', '\\':
+		return 2, nil
+	}
+	if len(s) < 3 || !isHex(s[1]) || !isHex(s[2]) {
+		return 0, errors.New("ldap: invalid escaped hex pair")
+	}
+	return 3, nil
+}
+
+// mustEscapeUnescaped are the bytes that RFC 4514's "escaped" production
+// (DQUOTE / PLUS / COMMA / SEMI / LANGLE / RANGLE) plus NUL require to be
+// escaped wherever they appear in a value; decodeString rejects them when
+// found literal (unescaped). COMMA and PLUS are not checked here because
+// parseValue already stops the value span at the first unescaped one of
+// those, so decodeString never sees them raw.
+const mustEscapeUnescaped = "\x00\";<>"
+
+// decodeString decodes an RFC 4514 string value, unescaping "\X"
+// special-character pairs and "\HH" hex pairs, rejecting any of RFC 4514's
+// mandatory-escape characters found unescaped, and stripping unescaped
+// leading and trailing spaces.
+func decodeString(str string) (string, error) {
+	var buf strings.Builder
+	trailingSpaces := 0
+	i := 0
+	for i < len(str) {
+		c := str[i]
+		switch {
+		case c == '\\':
+			n, err := parseEscape(str[i:])
+			if err != nil {
+				return "", err
+			}
+			if n == 2 {
+				buf.WriteByte(str[i+1])
+			} else {
+				b, err := enchex.DecodeString(str[i+1 : i+3])
 				if err != nil {
-					return nil, fmt.Errorf("Failed to decode BER encoding: %s", err)
+					return "", fmt.Errorf("ldap: invalid escaped hex pair: %s", err)
 				}
-				packet := ber.DecodePacket(rawBER)
-				buffer.WriteString(packet.Data.String())
-				i += len(data) - 1
-			}
-		} else if char == ',' || char == '+' {
-			// We're done with this RDN or value, push it
-			attribute.Value = stringFromBuffer()
-			rdn.Attributes = append(rdn.Attributes, attribute)
-			attribute = new(AttributeTypeAndValue)
-			if char == ',' {
-				dn.RDNs = append(dn.RDNs, rdn)
-				rdn = new(RelativeDN)
-				rdn.Attributes = make([]*AttributeTypeAndValue, 0)
+				buf.WriteByte(b[0])
 			}
-		} else if char == ' ' && buffer.Len() == 0 {
-			// ignore unescaped leading spaces
-			continue
-		} else {
-			if char == ' ' {
-				// Track unescaped spaces in case they are trailing and we need to remove them
-				unescapedTrailingSpaces++
+			i += n
+			trailingSpaces = 0
+		case c == ' ' && buf.Len() == 0:
+			i++
+		case strings.IndexByte(mustEscapeUnescaped, c) >= 0:
+			return "", fmt.Errorf("ldap: unescaped %q in value", c)
+		default:
+			if c == ' ' {
+				trailingSpaces++
 			} else {
-				// Reset if we see a non-space char
-				unescapedTrailingSpaces = 0
+				trailingSpaces = 0
 			}
-			buffer.WriteByte(char)
+			buf.WriteByte(c)
+			i++
 		}
 	}
-	if buffer.Len() > 0 {
-		if len(attribute.Type) == 0 {
-			return nil, errors.New("DN ended with incomplete type, value pair")
+	s := buf.String()
+	return s[:len(s)-trailingSpaces], nil
+}
+
+// isHex reports whether c is an ASCII hex digit.
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// parseHexValue consumes a "#"-prefixed hex-encoded DER value from the
+// front of s (s must already have the leading '#' stripped) and returns its
+// decoded form, along with the remaining unparsed string.
+func parseHexValue(s string) (string, string, error) {
+	hexStr := s
+	rest := ""
+	if i := strings.IndexAny(s, ",+"); i >= 0 {
+		hexStr, rest = s[:i], s[i:]
+	}
+	if hexStr == "" {
+		return "", "", errors.New("ldap: empty hex-encoded value")
+	}
+	value, err := decodeEncodedString(hexStr)
+	if err != nil {
+		return "", "", err
+	}
+	return value, rest, nil
+}
+
+// decodeEncodedString decodes a "#"-prefixed hex-encoded attribute value.
+// The hex bytes are decoded with encoding/hex and then unmarshaled as a
+// DER-encoded ASN.1 value with encoding/asn1, restricted to the string-like
+// tags that are actually valid for an LDAP AttributeValue: UTF8String,
+// PrintableString, IA5String, and OCTET STRING.
+//
+// This deliberately covers DER only, not the full generality of BER that
+// RFC 4514 permits for this production: we previously depended on
+// gopkg.in/asn1-ber.v1 here, which accepted arbitrary BER and rendered
+// whatever it decoded via its own Stringer, producing undefined output for
+// non-string types and taking on a heavyweight transitive dependency for a
+// single call site. encoding/asn1 only decodes DER, but every LDAP value
+// worth rendering as a string is DER already, so the restriction costs
+// nothing in practice and buys a clear error on unsupported or malformed
+// input instead of silent garbage. Trailing bytes and any other ASN.1 tag
+// are rejected outright.
+func decodeEncodedString(hex string) (string, error) {
+	der, err := enchex.DecodeString(hex)
+	if err != nil {
+		return "", fmt.Errorf("ldap: failed to decode hex-encoded value: %s", err)
+	}
+
+	var raw asn1.RawValue
+	rest, err := asn1.Unmarshal(der, &raw)
+	if err != nil {
+		return "", fmt.Errorf("ldap: failed to decode DER-encoded value: %s", err)
+	}
+	if len(rest) > 0 {
+		return "", errors.New("ldap: trailing data after DER-encoded value")
+	}
+
+	if raw.Class != asn1.ClassUniversal || raw.IsCompound {
+		return "", fmt.Errorf("ldap: unsupported ASN.1 class %d or constructed form in hex-encoded value", raw.Class)
+	}
+	switch raw.Tag {
+	case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, asn1.TagOctetString:
+		return string(raw.Bytes), nil
+	default:
+		return "", fmt.Errorf("ldap: unsupported ASN.1 tag %d in hex-encoded value", raw.Tag)
+	}
+}
+
+// encodeValue returns s escaped per RFC 4514 section 2.4: a leading '#' or space, a
+// trailing space, and any of '"', '+', ',', ';', '<', '>', '\', '=' are
+// escaped with the two-character "\X" form; NUL and any other non-printable
+// byte are escaped with the "\HH" hex-pair form.
+func encodeValue(s string) string {
+	if s == "" {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c == '#' || c == ' ') && i == 0:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == ' ' && i == len(s)-1:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case strings.IndexByte(specialChars, c) >= 0:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&buf, "\\%02x", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// String returns the RFC 4514 string representation of a, with the
+// attribute type normalized to lower case and the value escaped per section 2.4.
+func (a *AttributeTypeAndValue) String() string {
+	return strings.ToLower(a.Type) + "=" + encodeValue(a.Value)
+}
+
+// String returns the RFC 4514 string representation of r. A multi-valued
+// RDN is rendered as its attributeTypeAndValue strings joined with '+', in
+// sorted order, so that two RelativeDNs with the same attributes in a
+// different order produce the same string.
+func (r *RelativeDN) String() string {
+	parts := make([]string, len(r.Attributes))
+	for i, a := range r.Attributes {
+		parts[i] = a.String()
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "+")
+}
+
+// String returns the RFC 4514 string representation of dn: its RDNs,
+// normalized and joined with ','. The result is normalized (lower-cased
+// attribute types, escaped values, deterministically ordered multi-valued
+// RDNs), so ParseDN(dn.String()) round-trips.
+func (dn *DN) String() string {
+	if dn == nil {
+		return ""
+	}
+	rdns := make([]string, len(dn.RDNs))
+	for i, r := range dn.RDNs {
+		rdns[i] = r.String()
+	}
+	return strings.Join(rdns, ",")
+}
+
+// Equal returns true if dn and other represent the same distinguishedName.
+// Comparison is done on the normalized string form, so differences in
+// attribute-type case, whitespace, escaping, or the order of attributes within
+// a multi-valued RDN do not affect the result. Values compare case-sensitively.
+func (dn *DN) Equal(other *DN) bool {
+	if dn == nil || other == nil {
+		return dn == other
+	}
+	return dn.String() == other.String()
+}
+
+// AncestorOf returns true if dn is a strict ancestor of other, i.e. other is
+// somewhere below dn in the DN tree: other has more RDNs than dn, and dn's
+// RDNs match the rightmost (least-significant) RDNs of other.
+func (dn *DN) AncestorOf(other *DN) bool {
+	if dn == nil || other == nil || len(dn.RDNs) >= len(other.RDNs) {
+		return false
+	}
+	return hasSuffixRDNs(other.RDNs, dn.RDNs)
+}
+
+// HasSuffix returns true if base's RDNs are a suffix of dn's RDNs, i.e. dn is
+// base or a descendant of base in the DN tree.
+func (dn *DN) HasSuffix(base *DN) bool {
+	if dn == nil || base == nil {
+		return false
+	}
+	return hasSuffixRDNs(dn.RDNs, base.RDNs)
+}
+
+// hasSuffixRDNs reports whether suffix matches the trailing RDNs of rdns,
+// comparing each RDN via its normalized String() form so that attribute-type
+// case, whitespace, escaping, and the order of attributes within a multi-valued
+// RDN don't affect the result.
+func hasSuffixRDNs(rdns, suffix []*RelativeDN) bool {
+	if len(suffix) > len(rdns) {
+		return false
+	}
+	offset := len(rdns) - len(suffix)
+	for i, s := range suffix {
+		if rdns[offset+i].String() != s.String() {
+			return false
 		}
-		attribute.Value = stringFromBuffer()
-		rdn.Attributes = append(rdn.Attributes, attribute)
-		dn.RDNs = append(dn.RDNs, rdn)
 	}
-	return dn, nil
+	return true
 }
@@ -0,0 +1,216 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import "testing"
+
+func TestParseDNKnownGood(t *testing.T) {
+	cases := []struct {
+		name     string
+		in       string
+		wantRDNs int
+	}{
+		{"empty string is the null DN", "", 0},
+		{"single RDN", "cn=John Doe", 1},
+		{"multiple RDNs", "cn=John Doe,ou=People,dc=example,dc=com", 4},
+		{"multi-valued RDN", "ou=Sales+cn=J. Smith,dc=example,dc=com", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dn, err := ParseDN(c.in)
+			if err != nil {
+				t.Fatalf("ParseDN(%q) returned unexpected error: %s", c.in, err)
+			}
+			if len(dn.RDNs) != c.wantRDNs {
+				t.Errorf("ParseDN(%q) has %d RDNs, want %d", c.in, len(dn.RDNs), c.wantRDNs)
+			}
+		})
+	}
+}
+
+func TestParseDNRejectsUnescapedSpecials(t *testing.T) {
+	cases := []string{
+		`cn=a"b`,
+		"cn=a<b",
+		"cn=a>b",
+		"cn=a;b",
+		"cn=a\x00b",
+	}
+	for _, in := range cases {
+		t.Run(in, func(t *testing.T) {
+			if _, err := ParseDN(in); err == nil {
+				t.Errorf("ParseDN(%q) succeeded, want error for unescaped special character", in)
+			}
+		})
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"plain", "Jim Smith", "Jim Smith"},
+		{"leading hash", "#0102", "\\#0102"},
+		{"leading space", " leading", "\\ leading"},
+		{"trailing space", "trailing ", "trailing\\ "},
+		{"interior space not escaped", "a b c", "a b c"},
+		{"special characters", `a"b+c,d;e<f>g\h=i`, `a\"b\+c\,d\;e\<f\>g\\h\=i`},
+		{"NUL byte", "a\x00b", "a\\00b"},
+		{"other control byte", "a\x01b", "a\\01b"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := encodeValue(c.in); got != c.want {
+				t.Errorf("encodeValue(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEncodedString(t *testing.T) {
+	cases := []struct {
+		name    string
+		hex     string
+		want    string
+		wantErr bool
+	}{
+		{"UTF8String", "0c03414243", "ABC", false},
+		{"PrintableString", "1303414243", "ABC", false},
+		{"IA5String", "1603414243", "ABC", false},
+		{"OCTET STRING", "0403414243", "ABC", false},
+		{"unsupported tag (INTEGER)", "020101", "", true},
+		{"trailing bytes after value", "0c0341424300", "", true},
+		{"not valid hex", "zz", "", true},
+		{"not valid DER", "ff", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := decodeEncodedString(c.hex)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("decodeEncodedString(%q) = %q, nil; want error", c.hex, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeEncodedString(%q) returned unexpected error: %s", c.hex, err)
+			}
+			if got != c.want {
+				t.Errorf("decodeEncodedString(%q) = %q, want %q", c.hex, got, c.want)
+			}
+		})
+	}
+}
+
+func mustParseDN(t *testing.T, s string) *DN {
+	t.Helper()
+	dn, err := ParseDN(s)
+	if err != nil {
+		t.Fatalf("ParseDN(%q) failed: %s", s, err)
+	}
+	return dn
+}
+
+func TestDNAncestorOf(t *testing.T) {
+	cases := []struct {
+		name  string
+		dn    string
+		other string
+		want  bool
+	}{
+		{"strict ancestor", "ou=admins,dc=example,dc=com", "cn=bob,ou=admins,dc=example,dc=com", true},
+		{"self is not an ancestor of itself", "ou=admins,dc=example,dc=com", "ou=admins,dc=example,dc=com", false},
+		{"sibling is not an ancestor", "ou=admins,dc=example,dc=com", "ou=users,dc=example,dc=com", false},
+		{"descendant is not an ancestor of its ancestor", "cn=bob,ou=admins,dc=example,dc=com", "ou=admins,dc=example,dc=com", false},
+		{"case/whitespace/escape-insensitive match", "OU=Admins, DC=Example,DC=\\43om", "cn=bob,ou=Admins,dc=Example,dc=Com", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dn := mustParseDN(t, c.dn)
+			other := mustParseDN(t, c.other)
+			if got := dn.AncestorOf(other); got != c.want {
+				t.Errorf("DN(%q).AncestorOf(%q) = %v, want %v", c.dn, c.other, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDNHasSuffix(t *testing.T) {
+	cases := []struct {
+		name string
+		dn   string
+		base string
+		want bool
+	}{
+		{"descendant has suffix", "cn=bob,ou=admins,dc=example,dc=com", "ou=admins,dc=example,dc=com", true},
+		{"self has suffix of itself", "ou=admins,dc=example,dc=com", "ou=admins,dc=example,dc=com", true},
+		{"sibling does not have suffix", "ou=users,dc=example,dc=com", "ou=admins,dc=example,dc=com", false},
+		{"ancestor does not have suffix of its descendant", "ou=admins,dc=example,dc=com", "cn=bob,ou=admins,dc=example,dc=com", false},
+		{"case/whitespace/escape-insensitive match", "cn=bob,ou=Admins,dc=Example,dc=Com", "OU=Admins, DC=Example,DC=\\43om", true},
+		{"multi-valued RDN matches regardless of + order", "cn=bob,ou=admins+l=nyc,dc=example,dc=com", "l=nyc+ou=admins,dc=example,dc=com", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dn := mustParseDN(t, c.dn)
+			base := mustParseDN(t, c.base)
+			if got := dn.HasSuffix(base); got != c.want {
+				t.Errorf("DN(%q).HasSuffix(%q) = %v, want %v", c.dn, c.base, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRelativeDNStringSortsAttributes(t *testing.T) {
+	a := &RelativeDN{Attributes: []*AttributeTypeAndValue{
+		{Type: "cn", Value: "foo"},
+		{Type: "ou", Value: "bar"},
+	}}
+	b := &RelativeDN{Attributes: []*AttributeTypeAndValue{
+		{Type: "ou", Value: "bar"},
+		{Type: "cn", Value: "foo"},
+	}}
+	if a.String() != b.String() {
+		t.Errorf("RelativeDN.String() depends on attribute order: %q != %q", a.String(), b.String())
+	}
+}
+
+// FuzzParseDN asserts that ParseDN never panics on arbitrary input, and that
+// any string it does successfully parse round-trips: re-parsing dn.String()
+// must produce an equal DN.
+func FuzzParseDN(f *testing.F) {
+	seeds := []string{
+		"",
+		"cn=John Doe,ou=People,dc=example,dc=com",
+		"CN=Jim\\,2C Doe",
+		"cn=Jim\\+Doe",
+		"cn=#0c03414243",
+		"ou=Sales+cn=J. Smith,dc=example,dc=com",
+		"cn=\\ leading and trailing\\ ",
+		"cn=+cn=bad",
+		"cn=\\",
+		"cn=\\zz",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		dn, err := ParseDN(s)
+		if err != nil {
+			return
+		}
+
+		reparsed, err := ParseDN(dn.String())
+		if err != nil {
+			t.Fatalf("ParseDN(%q) succeeded but re-parsing its String() form %q failed: %s", s, dn.String(), err)
+		}
+		if !dn.Equal(reparsed) {
+			t.Fatalf("ParseDN(%q).String() = %q did not round-trip: got %q, want equal to original", s, dn.String(), reparsed.String())
+		}
+	})
+}